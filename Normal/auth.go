@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// loadDemoTokens อ่านรายการ "username:token" คั่นด้วย comma จาก env var AUTH_TOKENS
+// ใช้เป็นค่าเริ่มต้นของ InMemoryAuthenticator ตอน main() สตาร์ทเซิร์ฟเวอร์ สำหรับ production
+// ควรสลับไปใช้ NewFileAuthenticator หรือ HTTPAuthenticator แทน
+func loadDemoTokens() map[string]string {
+	tokens := make(map[string]string)
+	raw := os.Getenv("AUTH_TOKENS")
+	if raw == "" {
+		return tokens
+	}
+
+	for _, pair := range strings.Split(raw, ",") {
+		username, token, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok {
+			continue
+		}
+		tokens[username] = token
+	}
+	return tokens
+}
+
+// ErrInvalidCredentials คือ error มาตรฐานที่ Authenticator ทุกตัวคืนเมื่อ username/token ไม่ถูกต้อง
+var ErrInvalidCredentials = errors.New("invalid username or token")
+
+// Authenticator ตรวจสอบว่า username/token ที่ client ส่งมาในขั้นตอน auth ถูกต้องหรือไม่
+// แยกเป็น interface เพื่อให้สลับวิธีตรวจสอบได้โดยไม่ต้องแตะ handleConnection
+type Authenticator interface {
+	Authenticate(username, token string) error
+}
+
+// InMemoryAuthenticator ตรวจสอบจาก map username -> token ที่เก็บไว้ในหน่วยความจำ เหมาะกับ demo/ทดสอบ
+type InMemoryAuthenticator struct {
+	mu     sync.RWMutex
+	tokens map[string]string
+}
+
+// NewInMemoryAuthenticator สร้าง Authenticator จาก map username -> token ที่ให้มา (จะคัดลอกไว้เอง)
+func NewInMemoryAuthenticator(tokens map[string]string) *InMemoryAuthenticator {
+	copied := make(map[string]string, len(tokens))
+	for username, token := range tokens {
+		copied[username] = token
+	}
+	return &InMemoryAuthenticator{tokens: copied}
+}
+
+// Authenticate ตรวจสอบ username/token กับ map ที่เก็บไว้ในหน่วยความจำ
+func (a *InMemoryAuthenticator) Authenticate(username, token string) error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	want, ok := a.tokens[username]
+	if !ok || want != token {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
+
+// NewFileAuthenticator โหลดรายการ "username:token" จากไฟล์ข้อความ บรรทัดละหนึ่งคู่
+func NewFileAuthenticator(path string) (*InMemoryAuthenticator, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading auth file: %w", err)
+	}
+
+	tokens := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, token, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		tokens[username] = token
+	}
+	return NewInMemoryAuthenticator(tokens), nil
+}
+
+// HTTPAuthenticator มอบหมายการตรวจสอบ username/token ให้ HTTP endpoint ภายนอก
+// ถือว่าผ่านเมื่อ endpoint ตอบกลับด้วย status 200 เท่านั้น
+type HTTPAuthenticator struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewHTTPAuthenticator สร้าง HTTPAuthenticator ที่ยิง POST ไปยัง url เพื่อตรวจสอบ username/token
+func NewHTTPAuthenticator(url string) *HTTPAuthenticator {
+	return &HTTPAuthenticator{URL: url, Client: http.DefaultClient}
+}
+
+// authRequest คือ body ที่ส่งไปให้ HTTP authenticator endpoint ตรวจสอบ
+type authRequest struct {
+	Username string `json:"username"`
+	Token    string `json:"token"`
+}
+
+// Authenticate เรียก HTTP endpoint ภายนอกเพื่อตรวจสอบ username/token
+func (a *HTTPAuthenticator) Authenticate(username, token string) error {
+	body, err := json.Marshal(authRequest{Username: username, Token: token})
+	if err != nil {
+		return err
+	}
+
+	client := a.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Post(a.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
+
+// Session ผูก session ID ที่ server ออกให้กับข้อมูลผู้เล่นล่าสุด เพื่อให้ client ที่หลุดการเชื่อมต่อ
+// กลับมาด้วย session ID เดิมแล้วได้ Player state ของตัวเองคืนมา แทนที่จะเริ่มใหม่จากศูนย์
+type Session struct {
+	ID string
+
+	mu     sync.RWMutex
+	client *Client // nil เมื่อยังไม่มีการเชื่อมต่อที่ใช้งาน session นี้อยู่
+	player Player
+}
+
+func newSession(id string, player Player) *Session {
+	return &Session{ID: id, player: player}
+}
+
+// attach ผูก session เข้ากับ client ที่กำลังใช้งานอยู่ในขณะนี้ คืนค่า client เดิมที่เพิ่งถูกแทนที่
+// (nil ถ้าไม่มี) ผู้เรียกมีหน้าที่ตัดการเชื่อมต่อของ client เดิมนั้นทิ้ง เพื่อไม่ให้สอง connection
+// ถือ session เดียวกันพร้อมกัน
+func (s *Session) attach(c *Client) *Client {
+	s.mu.Lock()
+	old := s.client
+	s.client = c
+	s.mu.Unlock()
+	return old
+}
+
+// detach ปลด client ออกจาก session เมื่อหลุดการเชื่อมต่อ โดย Player state ยังอยู่เผื่อ reconnect
+// ปลดเฉพาะเมื่อ c ยังเป็น client ปัจจุบันของ session นี้จริง ๆ เพื่อไม่ให้ connection เก่าที่ถูก
+// attach ทับไปแล้ว (เช่นตอน reclaim session) มาล้างการผูกของ connection ใหม่ทิ้งโดยไม่ตั้งใจ คืนค่า
+// true ถ้า c เป็นเจ้าของจริงและถูกปลดไป ผู้เรียกใช้ค่านี้ตัดสินใจว่าควรประกาศ disconnect ให้ห้องรู้
+// หรือไม่ (connection ที่ถูกแทนที่ไปแล้วไม่ควรประกาศ เพราะผู้เล่นยังอยู่ผ่าน connection ใหม่)
+func (s *Session) detach(c *Client) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client != c {
+		return false
+	}
+	s.client = nil
+	return true
+}
+
+// setPlayer บันทึกข้อมูลผู้เล่นล่าสุดของ session นี้ไว้ เผื่อ client หลุดแล้วกลับมาเชื่อมต่อใหม่
+func (s *Session) setPlayer(p Player) {
+	s.mu.Lock()
+	s.player = p
+	s.mu.Unlock()
+}
+
+// snapshot คืนข้อมูลผู้เล่นล่าสุดที่รู้จักของ session นี้
+func (s *Session) snapshot() Player {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.player
+}
+
+// SessionRegistry เก็บ session ที่ยืนยันตัวตนสำเร็จแล้วทั้งหมด คีย์ด้วย session ID แทนชื่อผู้เล่น
+// เพื่อไม่ให้สองการเชื่อมต่อที่ใช้ชื่อเดียวกันทับ state กันเองแบบเงียบ ๆ อย่างที่เคยเป็นมา
+type SessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+func newSessionRegistry() *SessionRegistry {
+	return &SessionRegistry{sessions: make(map[string]*Session)}
+}
+
+// create ออก session ID ใหม่และบันทึก Player เริ่มต้นไว้ในทะเบียน
+func (r *SessionRegistry) create(player Player) *Session {
+	s := newSession(newSessionID(), player)
+	r.mu.Lock()
+	r.sessions[s.ID] = s
+	r.mu.Unlock()
+	return s
+}
+
+// find ค้นหา session จาก session ID ที่ client ส่งมาตอน auth เพื่อกู้คืน state เดิม
+func (r *SessionRegistry) find(id string) (*Session, bool) {
+	if id == "" {
+		return nil, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.sessions[id]
+	return s, ok
+}
+
+// newSessionID สุ่ม UUID v4 แบบง่าย ใช้เป็น session ID ที่ client เก็บไว้ใช้ reconnect
+func newSessionID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:]) // crypto/rand.Read ไม่คืน error จริงในทางปฏิบัติบน platform ที่รองรับ
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // variant 10
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
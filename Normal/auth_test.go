@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+// TestSessionReclaimDoesNotReportStaleOwnerAsCurrent ตรวจสอบ sequence ของการ reclaim session
+// เดียวกันด้วยสอง connection ติดต่อกัน (เช่นตอน client reconnect ด้วย session ID เดิมก่อนที่
+// connection เก่าจะถูกตรวจพบว่าหลุดไปเสียอีก) ว่า detach ของ connection เก่าที่ถูกแทนที่ไปแล้ว
+// ต้องคืนค่า false เสมอ (ผู้เรียกใน handleConnection ใช้ค่านี้ตัดสินใจไม่ประกาศ "disconnect" ปลอม
+// ให้ห้องรู้ทั้ง ๆ ที่ผู้เล่นยังเชื่อมต่ออยู่ผ่าน connection ใหม่) และ detach ของ connection ใหม่
+// ต้องคืนค่า true เมื่อมันหลุดจริง ๆ ในภายหลัง
+func TestSessionReclaimDoesNotReportStaleOwnerAsCurrent(t *testing.T) {
+	logger := NewStdLogger(LevelError)
+	sessions := newSessionRegistry()
+
+	session := sessions.create(Player{Username: "alice"})
+
+	first := newClient(nil, nil, logger)
+	if old := session.attach(first); old != nil {
+		t.Fatalf("attach(first) returned old client %v, want nil", old)
+	}
+
+	// client ที่สอง reconnect ด้วย session ID เดียวกัน (reclaim) ก่อนที่ first จะ cleanup ตัวเอง
+	second := newClient(nil, nil, logger)
+	old := session.attach(second)
+	if old != first {
+		t.Fatalf("attach(second) returned old client %v, want first %v", old, first)
+	}
+
+	// first cleanup ทีหลัง (ตาม defer ใน handleConnection) ต้อง detach ไม่สำเร็จ เพราะ second
+	// เป็นเจ้าของ session อยู่แล้ว - ผู้เรียกต้องไม่ประกาศ disconnect ให้ห้องรู้ในกรณีนี้
+	if detached := session.detach(first); detached {
+		t.Fatalf("detach(first) = true after reclaim, want false (would cause a spurious disconnect broadcast)")
+	}
+
+	// second cleanup ภายหลัง (การตัดการเชื่อมต่อจริง) ต้อง detach สำเร็จ เพื่อให้ประกาศ disconnect
+	// ให้ห้องรู้ตามปกติ
+	if detached := session.detach(second); !detached {
+		t.Fatalf("detach(second) = false, want true (second is still the session's live owner)")
+	}
+
+	// detach ซ้ำครั้งที่สองต้องไม่ทำอะไรอีก (idempotent ต่อ client ที่ไม่ได้เป็นเจ้าของแล้ว)
+	if detached := session.detach(second); detached {
+		t.Fatalf("detach(second) = true on second call, want false (already detached)")
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ค่าคงที่สำหรับปรับแต่งพฤติกรรมของ Hub ใช้เป็นค่าเริ่มต้นเมื่อไม่ได้ตั้ง env var ที่เกี่ยวข้อง
+// (ดู aoiRadiusFromEnv)
+const (
+	defaultAOIRadius = 50.0 // รัศมี (world unit) ที่ผู้เล่นจะเห็นการอัปเดตของผู้เล่นคนอื่น
+	gridCellSize     = 50.0 // ขนาดของแต่ละ cell ใน grid ที่ใช้ทำดัชนีตำแหน่งบนระนาบ X/Z
+	sendBufferSize   = 256  // ความจุของ channel `send` ต่อการเชื่อมต่อหนึ่งอัน
+	defaultTickRate  = 20   // จำนวนครั้งต่อวินาทีที่ hub คำนวณและส่ง state delta (Hz)
+
+	defaultTickInterval = time.Second / defaultTickRate
+)
+
+// aoiRadiusFromEnv อ่านรัศมี area-of-interest จาก env var AOI_RADIUS (world unit) เพื่อให้ปรับแต่งได้
+// โดยไม่ต้องแก้โค้ด ค่าที่ตั้งไม่ได้หรือ parse ไม่ขึ้น (รวมถึงค่าที่ <= 0) จะถูกเมินแล้วใช้
+// defaultAOIRadius แทน
+func aoiRadiusFromEnv() float64 {
+	raw := os.Getenv("AOI_RADIUS")
+	if raw == "" {
+		return defaultAOIRadius
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil || v <= 0 {
+		return defaultAOIRadius
+	}
+	return v
+}
+
+// tickIntervalFromEnv อ่านอัตรา tick จาก env var TICK_RATE (Hz) เพื่อให้ปรับแต่งได้โดยไม่ต้องแก้โค้ด
+// ค่าที่ตั้งไม่ได้หรือ parse ไม่ขึ้น (รวมถึงค่าที่ <= 0) จะถูกเมินแล้วใช้ defaultTickInterval แทน
+func tickIntervalFromEnv() time.Duration {
+	raw := os.Getenv("TICK_RATE")
+	if raw == "" {
+		return defaultTickInterval
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil || v <= 0 {
+		return defaultTickInterval
+	}
+	return time.Second / time.Duration(v)
+}
+
+// cellKey ระบุตำแหน่งของ cell หนึ่งใน grid ที่ใช้สำหรับค้นหาผู้เล่นที่อยู่ใกล้กัน (area-of-interest)
+type cellKey struct {
+	x, z int64
+}
+
+// cellFor คำนวณว่าพิกัด (x, z) ตกอยู่ใน cell ไหนของ grid ที่มีขนาด size
+func cellFor(x, z, size float64) cellKey {
+	return cellKey{x: int64(math.Floor(x / size)), z: int64(math.Floor(z / size))}
+}
+
+// withinRadius ตรวจสอบว่าผู้เล่นสองคนอยู่ใกล้กันในระยะ radius บนระนาบ X/Z หรือไม่
+func withinRadius(a, b Player, radius float64) bool {
+	dx := a.X - b.X
+	dz := a.Z - b.Z
+	return dx*dx+dz*dz <= radius*radius
+}
+
+// Client คือการเชื่อมต่อ WebSocket หนึ่งอันพร้อม channel สำหรับส่งข้อมูลออกของตัวเอง
+// เพื่อไม่ให้ goroutine ของ hub ต้องบล็อกรอ WriteJSON ของผู้เล่นคนอื่น
+type Client struct {
+	hub       *Hub
+	conn      *websocket.Conn
+	send      chan []byte
+	sessionID string // session ที่ client นี้ยืนยันตัวตนมาด้วย ใช้กู้คืน Player state เมื่อ reconnect
+	logger    Logger // ผูก remote_addr/session_id/username/room_id ไว้แล้ว ใช้แทน log แบบ free-form
+
+	mu      sync.RWMutex
+	pos     Player // ตำแหน่ง/ข้อมูลล่าสุดที่ผู้เล่นคนนี้รายงานเข้ามา
+	lastAck uint64 // tick ล่าสุดที่ client ยืนยันว่าได้รับแล้ว (รายงานมาพร้อม MovePayload.Ack)
+
+	// lastSent คือ state ล่าสุดที่ hub ส่งให้ client นี้ไปแล้ว (คีย์ด้วย *Client ไม่ใช่ username
+	// เพราะสอง connection อาจใช้ username เดียวกันชั่วคราวระหว่าง reconnect) ใช้คำนวณว่า tick
+	// ถัดไปมีอะไร added/moved/removed บ้าง เข้าถึงได้จาก hub goroutine เท่านั้น จึงไม่ต้องล็อก
+	lastSent map[*Client]Player
+}
+
+// newClient สร้าง Client ใหม่สำหรับการเชื่อมต่อหนึ่งอัน
+func newClient(hub *Hub, conn *websocket.Conn, logger Logger) *Client {
+	return &Client{
+		hub:      hub,
+		conn:     conn,
+		send:     make(chan []byte, sendBufferSize),
+		logger:   logger,
+		lastSent: make(map[*Client]Player),
+	}
+}
+
+// setPlayer บันทึกข้อมูลผู้เล่นล่าสุดที่ client นี้รายงานเข้ามา
+func (c *Client) setPlayer(p Player) {
+	c.mu.Lock()
+	c.pos = p
+	c.mu.Unlock()
+}
+
+// player คืนค่าข้อมูลผู้เล่นล่าสุดของ client นี้
+func (c *Client) player() Player {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.pos
+}
+
+// setAck บันทึก tick ล่าสุดที่ client ยืนยันว่าประมวลผลแล้ว ใช้ echo กลับไปใน state delta ถัดไป
+func (c *Client) setAck(tick uint64) {
+	c.mu.Lock()
+	c.lastAck = tick
+	c.mu.Unlock()
+}
+
+// ack คืน tick ล่าสุดที่ client ยืนยันว่าประมวลผลแล้ว
+func (c *Client) ack() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.lastAck
+}
+
+// writePump เป็นเจ้าของการเขียนลง conn แต่เพียงผู้เดียว โดยดึงข้อความจาก send channel
+// ไปเขียนทีละข้อความ ถ้าเขียนไม่สำเร็จ (เช่นสาย disconnect) ก็เลิก loop
+func (c *Client) writePump() {
+	defer c.conn.Close()
+	for msg := range c.send {
+		if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+			c.logger.Warn("error writing to client", F("error", err))
+			return
+		}
+	}
+	c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+}
+
+// broadcastUpdate คือคำขอให้ hub กระจายตำแหน่งใหม่ของผู้เล่นคนหนึ่งไปยังผู้เล่นที่อยู่ใกล้เคียง
+type broadcastUpdate struct {
+	from   *Client
+	player Player
+}
+
+// Hub ดูแลรายการ client ที่เชื่อมต่ออยู่ทั้งหมด และเป็นเจ้าของ world state ที่เชื่อถือได้ (authoritative)
+// ข้อความจาก client เพียงแก้ไข world state นี้ ส่วนการกระจายให้ client เห็นตำแหน่งของกันและกัน
+// เกิดขึ้นเป็น delta ทุก ๆ tick เท่านั้น ไม่ใช่ทันทีที่ได้รับข้อความเหมือนเดิมอีกต่อไป
+type Hub struct {
+	AOIRadius    float64
+	TickInterval time.Duration
+	logger       Logger
+
+	register   chan *Client
+	unregister chan *Client
+	update     chan broadcastUpdate
+	leave      chan string
+
+	mu      sync.Mutex
+	clients map[*Client]bool
+	grid    map[cellKey]map[*Client]bool
+
+	tick uint64 // หมายเลข tick ล่าสุดที่ส่งไปแล้ว เพิ่มขึ้นทีละหนึ่งทุก TickInterval
+}
+
+// newHub สร้าง Hub ใหม่พร้อม aoiRadius/tickInterval ที่กำหนด (ดู aoiRadiusFromEnv/tickIntervalFromEnv)
+// ต้องเรียก go hub.run() แยกต่างหากเสมอ
+func newHub(logger Logger, aoiRadius float64, tickInterval time.Duration) *Hub {
+	return &Hub{
+		AOIRadius:    aoiRadius,
+		TickInterval: tickInterval,
+		logger:       logger,
+		register:     make(chan *Client),
+		unregister:   make(chan *Client),
+		update:       make(chan broadcastUpdate),
+		leave:        make(chan string),
+		clients:      make(map[*Client]bool),
+		grid:         make(map[cellKey]map[*Client]bool),
+	}
+}
+
+// run คือ event loop หลักของ hub ทุกการเปลี่ยนแปลงสถานะ (register/unregister/update/leave)
+// ไหลผ่าน channel เดียวนี้ ทำให้ไม่ต้องล็อก mutex ขณะกระจายข้อความ ส่วน ticker ทำหน้าที่สั่งคำนวณ
+// และส่ง state delta ให้ client ทุกตัวที่อัตรา TickInterval
+func (h *Hub) run() {
+	ticker := time.NewTicker(h.TickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case c := <-h.register:
+			h.mu.Lock()
+			h.clients[c] = true
+			h.mu.Unlock()
+
+		case c := <-h.unregister:
+			h.mu.Lock()
+			if _, ok := h.clients[c]; ok {
+				delete(h.clients, c)
+				h.removeFromGridLocked(c)
+				close(c.send)
+			}
+			h.mu.Unlock()
+
+		case u := <-h.update:
+			h.applyUpdate(u)
+
+		case username := <-h.leave:
+			h.broadcastDisconnect(username)
+
+		case <-ticker.C:
+			h.runTick()
+		}
+	}
+}
+
+// applyUpdate บันทึกตำแหน่งใหม่ของผู้ส่งลงใน world state (grid) เท่านั้น ไม่กระจายข้อความทันที
+// การกระจายให้ client อื่นเห็นเกิดขึ้นที่ tick ถัดไปใน runTick แทน
+func (h *Hub) applyUpdate(u broadcastUpdate) {
+	old := u.from.player()
+	u.from.setPlayer(u.player)
+
+	h.mu.Lock()
+	h.moveInGridLocked(u.from, old, u.player)
+	h.mu.Unlock()
+}
+
+// runTick เพิ่มหมายเลข tick แล้วส่ง state delta ให้ client ที่เชื่อมต่ออยู่ทุกตัว
+func (h *Hub) runTick() {
+	h.tick++
+	tick := h.tick
+
+	h.mu.Lock()
+	clients := make([]*Client, 0, len(h.clients))
+	for c := range h.clients {
+		clients = append(clients, c)
+	}
+	h.mu.Unlock()
+
+	for _, c := range clients {
+		h.sendDelta(c, tick)
+	}
+}
+
+// sendDelta คำนวณว่าผู้เล่นที่อยู่ในรัศมีความสนใจของ c เปลี่ยนไปอย่างไรเทียบกับ tick ก่อนหน้า
+// (ใคร added/moved/removed) แล้วส่ง state delta กลับไปเฉพาะเมื่อมีการเปลี่ยนแปลงจริง ๆ
+func (h *Hub) sendDelta(c *Client, tick uint64) {
+	current := h.neighborSnapshot(c.player())
+
+	var added, moved []Player
+	for n, p := range current {
+		prev, existed := c.lastSent[n]
+		switch {
+		case !existed:
+			added = append(added, p)
+		case prev != p:
+			moved = append(moved, p)
+		}
+	}
+
+	var removed []string
+	for n, prev := range c.lastSent {
+		if _, ok := current[n]; !ok {
+			removed = append(removed, prev.Username)
+		}
+	}
+
+	c.lastSent = current
+	if len(added) == 0 && len(moved) == 0 && len(removed) == 0 {
+		return // ไม่มีอะไรเปลี่ยนในรัศมีของ client นี้ ไม่ต้องส่ง frame เปล่า ๆ ทุก tick
+	}
+
+	sendEnvelope(c, "state_delta", StateDeltaPayload{
+		Tick:    tick,
+		LastAck: c.ack(),
+		Added:   added,
+		Moved:   moved,
+		Removed: removed,
+	})
+}
+
+// neighborSnapshot คืนตำแหน่งล่าสุดของ client ที่อยู่ในรัศมีความสนใจของ p คีย์ด้วย *Client แทน
+// Username เพื่อไม่ให้สอง connection ที่บังเอิญใช้ username เดียวกัน (เช่นระหว่าง reclaim session)
+// ถูกยุบรวมเป็นคนเดียวกันตอนคำนวณ delta
+func (h *Hub) neighborSnapshot(p Player) map[*Client]Player {
+	h.mu.Lock()
+	neighbors := h.neighborsLocked(p)
+	h.mu.Unlock()
+
+	current := make(map[*Client]Player, len(neighbors))
+	for c := range neighbors {
+		current[c] = c.player()
+	}
+	return current
+}
+
+// snapshotNear คืนรายการผู้เล่นที่อยู่ในรัศมีความสนใจของ p ณ ขณะนี้ ใช้เป็น state snapshot
+// ให้ client ที่เพิ่งส่ง ping เข้ามา
+func (h *Hub) snapshotNear(p Player) []Player {
+	current := h.neighborSnapshot(p)
+	players := make([]Player, 0, len(current))
+	for _, pl := range current {
+		players = append(players, pl)
+	}
+	return players
+}
+
+// moveInGridLocked ย้าย client จาก cell เดิมไปยัง cell ใหม่ตามตำแหน่งล่าสุด
+// ต้องเรียกขณะถือ h.mu เท่านั้น
+func (h *Hub) moveInGridLocked(c *Client, old, updated Player) {
+	if old.Username != "" {
+		oldKey := cellFor(old.X, old.Z, gridCellSize)
+		if set, ok := h.grid[oldKey]; ok {
+			delete(set, c)
+			if len(set) == 0 {
+				delete(h.grid, oldKey)
+			}
+		}
+	}
+
+	newKey := cellFor(updated.X, updated.Z, gridCellSize)
+	set, ok := h.grid[newKey]
+	if !ok {
+		set = make(map[*Client]bool)
+		h.grid[newKey] = set
+	}
+	set[c] = true
+}
+
+// removeFromGridLocked ลบ client ออกจาก grid เมื่อตัดการเชื่อมต่อ ต้องเรียกขณะถือ h.mu เท่านั้น
+func (h *Hub) removeFromGridLocked(c *Client) {
+	p := c.player()
+	if p.Username == "" {
+		return
+	}
+	key := cellFor(p.X, p.Z, gridCellSize)
+	if set, ok := h.grid[key]; ok {
+		delete(set, c)
+		if len(set) == 0 {
+			delete(h.grid, key)
+		}
+	}
+}
+
+// neighborsLocked คืนรายชื่อ client ที่อยู่ในรัศมี AOIRadius ของ p โดยไล่ดูเฉพาะ cell
+// ที่อาจครอบคลุมระยะนั้น แทนที่จะวนดู client ทั้งหมด ต้องเรียกขณะถือ h.mu เท่านั้น
+func (h *Hub) neighborsLocked(p Player) map[*Client]bool {
+	result := make(map[*Client]bool)
+	center := cellFor(p.X, p.Z, gridCellSize)
+	reach := int64(math.Ceil(h.AOIRadius / gridCellSize))
+
+	for dx := -reach; dx <= reach; dx++ {
+		for dz := -reach; dz <= reach; dz++ {
+			key := cellKey{x: center.x + dx, z: center.z + dz}
+			for c := range h.grid[key] {
+				if withinRadius(p, c.player(), h.AOIRadius) {
+					result[c] = true
+				}
+			}
+		}
+	}
+	return result
+}
+
+// send ส่งข้อความให้ client แบบไม่บล็อก ถ้า send buffer เต็ม (client ช้า/ค้าง) จะตัดการเชื่อมต่อ
+// client นั้นทิ้งแทนที่จะยอมให้มันบล็อกการกระจายข้อความของผู้เล่นคนอื่น
+func (h *Hub) send(c *Client, data []byte) {
+	select {
+	case c.send <- data:
+	default:
+		h.mu.Lock()
+		if _, ok := h.clients[c]; ok {
+			delete(h.clients, c)
+			h.removeFromGridLocked(c)
+			close(c.send)
+		}
+		h.mu.Unlock()
+		c.logger.Warn("dropping slow client")
+	}
+}
+
+// broadcastDisconnect แจ้งผู้เล่นที่เชื่อมต่ออยู่ทั้งหมดว่าผู้เล่นคนหนึ่งตัดการเชื่อมต่อไปแล้ว
+func (h *Hub) broadcastDisconnect(username string) {
+	if username == "" {
+		return
+	}
+	h.broadcastAll("disconnect", DisconnectPayload{Username: username})
+}
+
+// broadcastAll เข้ารหัส payload เป็น envelope ตาม action ที่กำหนด แล้วส่งให้ client ที่เชื่อมต่อ
+// อยู่ทุกตัว (ไม่กรองตามรัศมีความสนใจ) ใช้กับข้อความที่ทุกคนต้องเห็น เช่น disconnect และ chat
+func (h *Hub) broadcastAll(action string, payload interface{}) {
+	data, err := encodeEnvelope(action, payload)
+	if err != nil {
+		h.logger.Error("error encoding broadcast message", F("error", err), F("action", action))
+		return
+	}
+
+	h.mu.Lock()
+	clients := make([]*Client, 0, len(h.clients))
+	for c := range h.clients {
+		clients = append(clients, c)
+	}
+	h.mu.Unlock()
+
+	for _, c := range clients {
+		h.send(c, data)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// LogLevel กำหนดระดับความสำคัญของ log แต่ละบรรทัด เรียงจากน้อยไปมาก
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// String คืนชื่อ level แบบตัวพิมพ์ใหญ่ ใช้ตอนพิมพ์บรรทัด log
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// ParseLogLevel แปลงชื่อ level จาก env var (ไม่สนตัวพิมพ์เล็กใหญ่) เป็น LogLevel
+// ถ้าไม่รู้จักชื่อที่ให้มา จะคืนค่า def แทน
+func ParseLogLevel(name string, def LogLevel) LogLevel {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LevelDebug
+	case "info":
+		return LevelInfo
+	case "warn", "warning":
+		return LevelWarn
+	case "error":
+		return LevelError
+	default:
+		return def
+	}
+}
+
+// Field คือคู่ key-value หนึ่งอันที่แนบไปกับบรรทัด log เช่น remote_addr, session_id, username, room_id
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F สร้าง Field ตัวหนึ่ง ใช้ตอนเรียก logger เพื่อให้อ่านง่ายกว่าสร้าง Field{} ตรง ๆ
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Logger คือ interface ของ logger ที่ใช้ทั่วทั้งเซิร์ฟเวอร์ With ใช้ผูก field ประจำตัว
+// (เช่น remote_addr, session_id, username, room_id) เพื่อให้ log ทุกบรรทัดของการเชื่อมต่อเดียวกัน
+// มี context ติดไปด้วยเสมอโดยไม่ต้องส่ง field เดิมซ้ำทุกครั้งที่เรียก
+type Logger interface {
+	Debug(msg string, fields ...Field)
+	Info(msg string, fields ...Field)
+	Warn(msg string, fields ...Field)
+	Error(msg string, fields ...Field)
+	With(fields ...Field) Logger
+}
+
+// formatLine เรียง field ตามลำดับที่ถูกผูกเข้ามา (ไม่ sort ตามตัวอักษร) ให้อ่านบรรทัดต่อบรรทัดได้ง่าย
+func formatLine(level LogLevel, msg string, fields []Field) string {
+	var b strings.Builder
+	b.WriteString("[")
+	b.WriteString(level.String())
+	b.WriteString("] ")
+	b.WriteString(msg)
+	for _, f := range fields {
+		fmt.Fprintf(&b, " %s=%v", f.Key, f.Value)
+	}
+	return b.String()
+}
+
+// StdLogger เป็น adapter บน log.Logger มาตรฐานของ Go แบบไม่มี dependency ภายนอก
+// เหมาะกับ production ที่ส่ง stderr ต่อให้ log aggregator ประมวลผลเป็น plain text เอง
+type StdLogger struct {
+	logger *log.Logger
+	level  LogLevel
+	fields []Field
+}
+
+// NewStdLogger สร้าง StdLogger ที่เขียนไปยัง os.Stderr กรองด้วย level ที่กำหนด
+func NewStdLogger(level LogLevel) *StdLogger {
+	return &StdLogger{logger: log.New(os.Stderr, "", log.LstdFlags), level: level}
+}
+
+func (l *StdLogger) log(level LogLevel, msg string, fields []Field) {
+	if level < l.level {
+		return
+	}
+	l.logger.Println(formatLine(level, msg, append(l.fields, fields...)))
+}
+
+func (l *StdLogger) Debug(msg string, fields ...Field) { l.log(LevelDebug, msg, fields) }
+func (l *StdLogger) Info(msg string, fields ...Field)  { l.log(LevelInfo, msg, fields) }
+func (l *StdLogger) Warn(msg string, fields ...Field)  { l.log(LevelWarn, msg, fields) }
+func (l *StdLogger) Error(msg string, fields ...Field) { l.log(LevelError, msg, fields) }
+
+// With คืน logger ตัวใหม่ที่ผูก field เพิ่มเติมเข้ากับ field เดิมที่มีอยู่แล้ว
+func (l *StdLogger) With(fields ...Field) Logger {
+	return &StdLogger{logger: l.logger, level: l.level, fields: append(append([]Field{}, l.fields...), fields...)}
+}
+
+// สีของแต่ละ log level สำหรับ ColorLogger
+const (
+	colorReset  = "\x1b[0m"
+	colorGray   = "\x1b[90m"
+	colorCyan   = "\x1b[36m"
+	colorYellow = "\x1b[33m"
+	colorRed    = "\x1b[31m"
+)
+
+func colorFor(level LogLevel) string {
+	switch level {
+	case LevelDebug:
+		return colorGray
+	case LevelInfo:
+		return colorCyan
+	case LevelWarn:
+		return colorYellow
+	case LevelError:
+		return colorRed
+	default:
+		return colorReset
+	}
+}
+
+// ColorLogger พิมพ์ log ไปยัง stderr แบบมีสีตาม level เหมาะกับดู log สดตอนพัฒนา
+type ColorLogger struct {
+	level  LogLevel
+	fields []Field
+}
+
+// NewColorLogger สร้าง ColorLogger ที่กรองด้วย level ที่กำหนด
+func NewColorLogger(level LogLevel) *ColorLogger {
+	return &ColorLogger{level: level}
+}
+
+func (l *ColorLogger) log(level LogLevel, msg string, fields []Field) {
+	if level < l.level {
+		return
+	}
+	line := formatLine(level, msg, append(l.fields, fields...))
+	fmt.Fprintln(os.Stderr, colorFor(level)+line+colorReset)
+}
+
+func (l *ColorLogger) Debug(msg string, fields ...Field) { l.log(LevelDebug, msg, fields) }
+func (l *ColorLogger) Info(msg string, fields ...Field)  { l.log(LevelInfo, msg, fields) }
+func (l *ColorLogger) Warn(msg string, fields ...Field)  { l.log(LevelWarn, msg, fields) }
+func (l *ColorLogger) Error(msg string, fields ...Field) { l.log(LevelError, msg, fields) }
+
+// With คืน logger ตัวใหม่ที่ผูก field เพิ่มเติมเข้ากับ field เดิมที่มีอยู่แล้ว
+func (l *ColorLogger) With(fields ...Field) Logger {
+	return &ColorLogger{level: l.level, fields: append(append([]Field{}, l.fields...), fields...)}
+}
+
+// newLoggerFromEnv สร้าง root Logger ตาม config flag LOG_FORMAT ("stdlib" หรือ "color")
+// และ LogLevel จาก env var LOG_LEVEL (debug/info/warn/error) ค่าเริ่มต้นคือ stdlib ที่ level info
+func newLoggerFromEnv() Logger {
+	level := ParseLogLevel(os.Getenv("LOG_LEVEL"), LevelInfo)
+
+	if strings.ToLower(os.Getenv("LOG_FORMAT")) == "color" {
+		return NewColorLogger(level)
+	}
+	return NewStdLogger(level)
+}
@@ -2,9 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
-	"sync"
 
 	"github.com/gorilla/websocket"
 )
@@ -17,14 +17,6 @@ type Player struct {
 	Z        float64 `json:"Z"`        // พิกัด Z ของผู้เล่น
 }
 
-// ตัวแปรที่ใช้สำหรับการจัดการการเข้าถึงข้อมูลที่ใช้ร่วมกัน (Shared Resources) ด้วย Mutex
-var (
-	players       = make(map[string]Player)        // เก็บข้อมูลผู้เล่นทั้งหมด
-	playersMu     sync.Mutex                       // ใช้ล็อกเพื่อให้การเข้าถึงข้อมูลใน map `players` เป็นไปอย่างปลอดภัย
-	connections   = make(map[*websocket.Conn]bool) // เก็บการเชื่อมต่อ WebSocket
-	connectionsMu sync.Mutex                       // ใช้ล็อกเพื่อให้การเข้าถึงข้อมูลใน map `connections` เป็นไปอย่างปลอดภัย
-)
-
 // WebSocket Upgrader ใช้สำหรับอัพเกรดการเชื่อมต่อ HTTP ให้เป็น WebSocket
 var upgrader = websocket.Upgrader{
 	// ตรวจสอบแหล่งที่มาของคำขอ (Origins) ซึ่งในที่นี้อนุญาตให้เชื่อมต่อจากทุกแหล่ง
@@ -33,108 +25,133 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
-// handleConnection ใช้สำหรับจัดการการเชื่อมต่อ WebSocket สำหรับแต่ละการเชื่อมต่อ
-func handleConnection(conn *websocket.Conn) {
-	defer conn.Close() // เมื่อเสร็จสิ้นการทำงานให้ปิดการเชื่อมต่อ
-
-	// เพิ่มการเชื่อมต่อใหม่ใน map connections
-	connectionsMu.Lock()
-	connections[conn] = true
-	connectionsMu.Unlock()
-
-	var player Player // ตัวแปรเพื่อเก็บข้อมูลของผู้เล่น
+// authenticateConnection อ่านข้อความถัดไปของ conn (ข้อความแรกหลัง resolveRoom) ซึ่งต้องเป็น envelope action "auth"
+// ตรวจสอบ username/token ผ่าน authenticator แล้วผูกเข้ากับ session เดิม (ถ้ามี SessionID
+// ที่ใช้งานได้) หรือสร้าง session ใหม่ให้ การเชื่อมต่อจะยังไม่ถูกลงทะเบียนเข้า hub จนกว่าขั้นตอนนี้จะสำเร็จ
+// logger ที่ส่งเข้ามาจะถูกผูก username/session_id เพิ่มเติมให้ client ที่สร้างสำเร็จ
+func authenticateConnection(hub *Hub, sessions *SessionRegistry, authenticator Authenticator, conn *websocket.Conn, logger Logger) (*Client, error) {
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		return nil, fmt.Errorf("reading auth message: %w", err)
+	}
 
-	// อ่านข้อความจากการเชื่อมต่อในลูปต่อเนื่อง
-	for {
-		// อ่านข้อความจากการเชื่อมต่อ WebSocket
-		_, msg, err := conn.ReadMessage()
-		if err != nil {
-			log.Println("Error reading message:", err)
-			break // ถ้ามีข้อผิดพลาดให้หยุดการทำงาน
-		}
+	var env Envelope
+	if err := json.Unmarshal(msg, &env); err != nil {
+		return nil, fmt.Errorf("invalid auth envelope: %w", err)
+	}
+	if env.Action != "auth" {
+		return nil, fmt.Errorf("expected auth action, got %q", env.Action)
+	}
 
-		// แปลงข้อความที่ได้รับให้เป็นข้อมูลของผู้เล่น
-		if err := json.Unmarshal(msg, &player); err != nil {
-			log.Println("Invalid JSON:", err) // ถ้าแปลงข้อมูลไม่ได้ แสดงข้อผิดพลาด
-			continue                          // ข้ามการประมวลผลในรอบนี้ไป
-		}
+	var auth AuthPayload
+	if err := json.Unmarshal(env.Payload, &auth); err != nil {
+		return nil, fmt.Errorf("invalid auth payload: %w", err)
+	}
 
-		// ตรวจสอบว่าชื่อผู้เล่นไม่ว่างเปล่า
-		if player.Username == "" {
-			log.Println("Invalid Player data: Username is empty") // ถ้าชื่อผู้เล่นว่าง
-			continue                                              // ข้ามการประมวลผลในรอบนี้ไป
-		}
+	if err := authenticator.Authenticate(auth.Username, auth.Token); err != nil {
+		return nil, err
+	}
 
-		// Log the player's login details
-		log.Printf("Player %s logged in from %s\n", player.Username, conn.RemoteAddr())
+	session, ok := sessions.find(auth.SessionID)
+	if !ok || session.snapshot().Username != auth.Username {
+		session = sessions.create(Player{Username: auth.Username})
+	}
 
-		// อัปเดตข้อมูลของผู้เล่นใน map `players` ด้วยการใช้ Mutex เพื่อให้การเข้าถึงข้อมูลปลอดภัย
-		playersMu.Lock()
-		players[player.Username] = player
-		playersMu.Unlock()
+	client := newClient(hub, conn, logger.With(F("username", auth.Username), F("session_id", session.ID)))
+	client.sessionID = session.ID
+	client.setPlayer(session.snapshot())
 
-		// แจ้งการอัปเดตข้อมูลของผู้เล่นให้กับผู้เล่นคนอื่น ๆ ผ่านการกระจายข้อมูล
-		broadcastPlayerUpdate(player)
+	if old := session.attach(client); old != nil {
+		old.logger.Info("session reclaimed by a new connection, kicking stale connection")
+		sendEnvelope(old, "error", ErrorPayload{Message: "session reclaimed from another connection"})
+		old.conn.Close()
 	}
 
-	// เมื่อการเชื่อมต่อสิ้นสุดลง ให้ลบการเชื่อมต่อนั้นออกจาก map `connections`
-	connectionsMu.Lock()
-	delete(connections, conn)
-	connectionsMu.Unlock()
-
-	// แจ้งเตือนผู้เล่นคนอื่น ๆ เกี่ยวกับการตัดการเชื่อมต่อของผู้เล่นนี้
-	broadcastDisconnect(player.Username)
-	log.Println("Connection closed:", conn.RemoteAddr())
+	return client, nil
 }
 
-// broadcastPlayerUpdate ส่งข้อมูลของผู้เล่นที่อัปเดตให้กับทุกการเชื่อมต่อ WebSocket ที่เปิดอยู่
-func broadcastPlayerUpdate(player Player) {
-	connectionsMu.Lock() // ล็อกการเข้าถึง map `connections`
-	defer connectionsMu.Unlock()
-
-	// ส่งข้อมูลผู้เล่นให้กับทุกการเชื่อมต่อ
-	for conn := range connections {
-		if err := conn.WriteJSON(player); err != nil {
-			log.Println("Error sending player data:", err) // ถ้ามีข้อผิดพลาดในการส่งข้อมูล
-		}
+// handleConnection ใช้สำหรับจัดการการเชื่อมต่อ WebSocket สำหรับแต่ละการเชื่อมต่อ
+// การส่งข้อมูลออกทั้งหมดไหลผ่าน client.send แทนการเขียนลง conn ตรง ๆ ที่นี่
+// เพื่อไม่ให้ client ที่ช้าบล็อกการอัปเดตของผู้เล่นคนอื่นใน hub ของห้องนั้น
+func handleConnection(room *Room, sessions *SessionRegistry, authenticator Authenticator, conn *websocket.Conn, logger Logger) {
+	hub := room.Hub
+
+	client, err := authenticateConnection(hub, sessions, authenticator, conn, logger)
+	if err != nil {
+		logger.Warn("authentication failed", F("error", err))
+		conn.Close()
+		return
 	}
-}
 
-// broadcastDisconnect ส่งข้อความการตัดการเชื่อมต่อไปยังทุกการเชื่อมต่อ WebSocket
-func broadcastDisconnect(username string) {
-	// สร้างข้อความแจ้งการตัดการเชื่อมต่อ
-	disconnectMsg := map[string]string{
-		"action":   "disconnect", // การกระทำที่เกิดขึ้นคือการตัดการเชื่อมต่อ
-		"username": username,     // ชื่อผู้เล่นที่ตัดการเชื่อมต่อ
-	}
+	hub.register <- client
+	go client.writePump()
+	sendEnvelope(client, "auth_success", AuthSuccessPayload{SessionID: client.sessionID})
 
-	connectionsMu.Lock() // ล็อกการเข้าถึง map `connections`
-	defer connectionsMu.Unlock()
+	// ประกาศตำแหน่งล่าสุดของ client (ที่อาจกู้คืนมาจาก session เดิม) ให้เข้า grid ทันที
+	hub.update <- broadcastUpdate{from: client, player: client.player()}
 
-	// ส่งข้อความการตัดการเชื่อมต่อให้กับทุกการเชื่อมต่อ
-	for conn := range connections {
-		if err := conn.WriteJSON(disconnectMsg); err != nil {
-			log.Println("Error sending disconnect message:", err) // ถ้ามีข้อผิดพลาดในการส่งข้อความ
+	defer func() {
+		hub.unregister <- client
+		superseded := false
+		if session, ok := sessions.find(client.sessionID); ok {
+			session.setPlayer(client.player())
+			superseded = !session.detach(client)
+		}
+		// ถ้า session นี้ถูกแทนที่ไปแล้ว (superseded) client ตัวนี้ไม่ใช่เจ้าของปัจจุบันอีกต่อไป
+		// ผู้เล่นยังคงอยู่ผ่าน connection ใหม่ จึงไม่ประกาศ disconnect ปลอมให้ห้องรู้
+		if !superseded {
+			hub.leave <- client.player().Username
 		}
+		client.logger.Info("connection closed")
+	}()
+
+	// อ่านข้อความจากการเชื่อมต่อในลูปต่อเนื่อง แต่ละข้อความคือ envelope ที่มี action ของตัวเอง
+	// (move/leave/chat/ping) ไม่ใช่ Player ดิบ ๆ เหมือนเดิมอีกต่อไป
+	for {
+		// อ่านข้อความจากการเชื่อมต่อ WebSocket
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			client.logger.Debug("error reading message", F("error", err))
+			return // ถ้ามีข้อผิดพลาดให้หยุดการทำงาน
+		}
+
+		dispatch(client, msg)
 	}
 }
 
 // main ฟังก์ชันหลักที่ใช้เริ่มต้นเซิร์ฟเวอร์ HTTP และจัดการคำขอ WebSocket
 func main() {
+	logger := newLoggerFromEnv()
+
+	rooms := newRoomRegistry(logger, aoiRadiusFromEnv(), tickIntervalFromEnv())
+	sessions := newSessionRegistry()
+	authenticator := NewInMemoryAuthenticator(loadDemoTokens())
+
 	// ตั้งค่าให้เซิร์ฟเวอร์ HTTP รับคำขอที่เส้นทาง /ws
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		connLogger := logger.With(F("remote_addr", r.RemoteAddr))
+
 		// อัพเกรดการเชื่อมต่อ HTTP เป็น WebSocket
 		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
-			log.Println("Error upgrading connection:", err) // ถ้ามีข้อผิดพลาดในการอัพเกรดการเชื่อมต่อ
+			connLogger.Error("error upgrading connection", F("error", err)) // ถ้ามีข้อผิดพลาดในการอัพเกรดการเชื่อมต่อ
+			return
+		}
+
+		// หาห้องที่ client นี้จะเข้าร่วม จาก ?room=/?passphrase= หรือ action "join_room"
+		room, err := resolveRoom(rooms, r, conn)
+		if err != nil {
+			connLogger.Warn("room resolution failed", F("error", err))
+			conn.Close()
 			return
 		}
+		connLogger = connLogger.With(F("room_id", room.ID))
 
 		// เรียกฟังก์ชัน handleConnection เพื่อจัดการการเชื่อมต่อ WebSocket นี้
-		handleConnection(conn)
+		handleConnection(room, sessions, authenticator, conn, connLogger)
 	})
 
 	// เริ่มต้นเซิร์ฟเวอร์ HTTP ที่พอร์ต 8080
-	log.Println("Server started on :8080")
+	logger.Info("server started", F("addr", ":8080"))
 	log.Fatal(http.ListenAndServe(":8080", nil)) // เริ่มเซิร์ฟเวอร์และจัดการคำขอ
 }
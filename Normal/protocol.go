@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Envelope คือรูปแบบมาตรฐานของทุกข้อความที่วิ่งผ่าน WebSocket ทั้งขาเข้าและขาออก
+// Action บอกว่าข้อความนี้คืออะไร ส่วน Payload เก็บข้อมูลจริงไว้แบบ raw เพื่อให้ handler
+// ของแต่ละ action แกะ (unmarshal) เป็น type ของตัวเองอีกที
+type Envelope struct {
+	Action  string          `json:"action"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// ---- payload ของข้อความที่ client ส่งเข้ามา ----
+
+// AuthPayload คือข้อมูลยืนยันตัวตนที่ client ต้องส่งเป็นข้อความแรกหลังเลือกห้องแล้ว ก่อนเข้าสู่โลก
+// (ถ้าไม่ได้ระบุห้องใน query ข้อความนี้จะตามหลังข้อความ join_room)
+// ถ้ามี SessionID จากการเชื่อมต่อครั้งก่อน server จะพยายามกู้คืน Player state เดิมให้
+type AuthPayload struct {
+	Username  string `json:"username"`
+	Token     string `json:"token"`
+	SessionID string `json:"session_id,omitempty"`
+}
+
+// JoinRoomPayload คือห้องที่ client ต้องการเข้าร่วม ใช้เมื่อไม่ได้ระบุทั้ง ?room= และ ?passphrase= ตอนเปิด WebSocket
+// ต้องระบุอย่างใดอย่างหนึ่งระหว่าง RoomID กับ Passphrase
+type JoinRoomPayload struct {
+	RoomID     string `json:"room_id,omitempty"`
+	Passphrase string `json:"passphrase,omitempty"`
+}
+
+// MovePayload คือตำแหน่งใหม่ของผู้เล่นที่ client รายงานเข้ามา Ack คือหมายเลข tick ล่าสุดจาก
+// StateDeltaPayload ที่ client ประมวลผลแล้ว ใช้ echo กลับไปให้ client ทำ reconciliation ต่อ
+type MovePayload struct {
+	X   float64 `json:"x"`
+	Y   float64 `json:"y"`
+	Z   float64 `json:"z"`
+	Ack uint64  `json:"ack,omitempty"`
+}
+
+// ChatPayload คือข้อความแชทที่ client ส่งเข้ามาเพื่อกระจายให้ทุกคน
+type ChatPayload struct {
+	Message string `json:"message"`
+}
+
+// ---- payload ของข้อความที่ server ส่งออกไป ----
+
+// AuthSuccessPayload คือคำตอบเมื่อยืนยันตัวตนสำเร็จ พร้อม session ID ที่ client ต้องเก็บไว้
+// เพื่อใช้ reconnect และกู้คืน Player state เดิมในอนาคต
+type AuthSuccessPayload struct {
+	SessionID string `json:"session_id"`
+}
+
+// StatePayload คือสถานะผู้เล่นที่อยู่ในรัศมีความสนใจของ client ณ เวลาที่ขอ (full snapshot)
+type StatePayload struct {
+	Players []Player `json:"players"`
+}
+
+// StateDeltaPayload คือส่วนต่างของผู้เล่นในรัศมีความสนใจของ client เทียบกับ tick ก่อนหน้า
+// hub คำนวณให้ทุก client ทุก ๆ TickInterval แทนการกระจายทันทีที่มีคนขยับ แต่ส่งเฉพาะ tick ที่มี
+// การเปลี่ยนแปลงในรัศมีของ client นั้น tick ที่ไม่มีอะไรเปลี่ยนจะไม่มี frame ส่งออกไป
+type StateDeltaPayload struct {
+	Tick    uint64   `json:"tick"`
+	LastAck uint64   `json:"last_ack"`
+	Added   []Player `json:"added,omitempty"`
+	Moved   []Player `json:"moved,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// ChatBroadcastPayload คือข้อความแชทที่ถูกกระจายไปยัง client อื่น ๆ พร้อมชื่อผู้ส่ง
+type ChatBroadcastPayload struct {
+	Username string `json:"username"`
+	Message  string `json:"message"`
+}
+
+// DisconnectPayload แจ้งว่าผู้เล่นคนไหนตัดการเชื่อมต่อไปแล้ว
+type DisconnectPayload struct {
+	Username string `json:"username"`
+}
+
+// ErrorPayload แจ้งข้อผิดพลาดกลับไปยัง client ตัวเดียวที่ทำให้เกิดข้อผิดพลาดนั้น
+type ErrorPayload struct {
+	Message string `json:"message"`
+}
+
+// HandlerFunc คือ handler ของ action หนึ่งตัว รับ client ที่ส่งข้อความมาและ payload แบบ raw
+type HandlerFunc func(c *Client, payload json.RawMessage)
+
+var handlers = make(map[string]HandlerFunc)
+
+// RegisterHandler ลงทะเบียน handler สำหรับ action หนึ่ง ๆ เรียกใน init() ของไฟล์นี้
+// สำหรับ action มาตรฐาน หรือจากที่อื่นถ้าต้องการเพิ่ม action ใหม่ในอนาคต
+func RegisterHandler(action string, fn HandlerFunc) {
+	handlers[action] = fn
+}
+
+func init() {
+	RegisterHandler("move", handleMove)
+	RegisterHandler("leave", handleLeave)
+	RegisterHandler("chat", handleChat)
+	RegisterHandler("ping", handlePing)
+}
+
+// dispatch แกะ envelope จากข้อความดิบที่อ่านได้จาก socket แล้วส่งต่อให้ handler ที่ลงทะเบียนไว้
+// ถ้า action ไม่รู้จักหรือ payload ผิดรูปแบบ จะตอบกลับด้วย action "error" ไปยัง client ตัวนั้น
+func dispatch(c *Client, raw []byte) {
+	var env Envelope
+	if err := json.Unmarshal(raw, &env); err != nil {
+		c.logger.Warn("invalid envelope JSON", F("error", err))
+		sendError(c, "invalid envelope")
+		return
+	}
+
+	fn, ok := handlers[env.Action]
+	if !ok {
+		c.logger.Warn("unknown action", F("action", env.Action))
+		sendError(c, fmt.Sprintf("unknown action %q", env.Action))
+		return
+	}
+
+	fn(c, env.Payload)
+}
+
+// sendEnvelope เข้ารหัส payload เป็น envelope ตาม action ที่กำหนด แล้วส่งให้ client ตัวเดียว
+// ผ่าน hub เพื่อใช้ non-blocking send/drop เดียวกับการกระจายข้อความอื่น ๆ
+func sendEnvelope(c *Client, action string, payload interface{}) {
+	data, err := encodeEnvelope(action, payload)
+	if err != nil {
+		c.logger.Error("error encoding envelope", F("error", err), F("action", action))
+		return
+	}
+	c.hub.send(c, data)
+}
+
+// encodeEnvelope แปลง payload ให้เป็น []byte ของ envelope ที่พร้อมส่งผ่าน socket
+func encodeEnvelope(action string, payload interface{}) ([]byte, error) {
+	rawPayload, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(Envelope{Action: action, Payload: rawPayload})
+}
+
+// sendError ส่งข้อความ error กลับไปยัง client ตัวเดียวที่ทำให้เกิดปัญหา
+func sendError(c *Client, message string) {
+	sendEnvelope(c, "error", ErrorPayload{Message: message})
+}
+
+// handleMove ประมวลผล action "move" ซึ่งอัปเดตตำแหน่งของผู้เล่นที่ auth ไว้แล้วเท่านั้น
+func handleMove(c *Client, payload json.RawMessage) {
+	username := c.player().Username
+
+	var p MovePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		c.logger.Warn("invalid move payload", F("error", err))
+		sendError(c, "invalid move payload")
+		return
+	}
+
+	c.setAck(p.Ack)
+	c.logger.Debug("move received", F("x", p.X), F("y", p.Y), F("z", p.Z), F("ack", p.Ack))
+	c.hub.update <- broadcastUpdate{from: c, player: Player{Username: username, X: p.X, Y: p.Y, Z: p.Z}}
+}
+
+// handleLeave ประมวลผล action "leave" ซึ่งเป็นการขอออกจากโลกโดยสมัครใจของ client เอง
+// การปิด conn จะทำให้ลูปอ่านข้อความใน handleConnection เจอ error แล้ว cleanup ตามปกติ
+func handleLeave(c *Client, _ json.RawMessage) {
+	c.conn.Close()
+}
+
+// handleChat ประมวลผล action "chat" และกระจายข้อความแชทไปยังผู้เล่นทุกคนที่เชื่อมต่ออยู่
+func handleChat(c *Client, payload json.RawMessage) {
+	username := c.player().Username
+
+	var p ChatPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		c.logger.Warn("invalid chat payload", F("error", err))
+		sendError(c, "invalid chat payload")
+		return
+	}
+
+	c.logger.Info("chat message", F("message", p.Message))
+	c.hub.broadcastAll("chat", ChatBroadcastPayload{Username: username, Message: p.Message})
+}
+
+// handlePing ประมวลผล action "ping" โดยตอบกลับด้วย snapshot ของผู้เล่นที่อยู่ในรัศมีความสนใจ
+// ปัจจุบันใช้เป็นทั้ง keepalive และช่องทาง sync สถานะของ client
+func handlePing(c *Client, _ json.RawMessage) {
+	players := c.hub.snapshotNear(c.player())
+	c.logger.Debug("ping", F("players_nearby", len(players)))
+	sendEnvelope(c, "state", StatePayload{Players: players})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// defaultRoomID คือห้องที่ newRoomRegistry สร้างไว้ล่วงหน้าเสมอ client เข้าได้ด้วย ?room=lobby หรือ
+// join_room ที่มี room_id "lobby" ส่วน resolveRoom ไม่ได้ส่ง client ที่ไม่ระบุห้องมาที่ห้องนี้ให้เอง
+const defaultRoomID = "lobby"
+
+// Room คือโลก/ห้องเกมหนึ่งห้อง มี hub ของตัวเอง ทำให้ผู้เล่นในคนละห้องไม่เห็นการอัปเดตของกันและกัน
+type Room struct {
+	ID         string
+	Passphrase string
+	Hub        *Hub
+}
+
+// newRoom สร้างห้องใหม่พร้อม hub ของตัวเอง และสตาร์ท hub.run() ให้ทันที
+// logger ที่ส่งเข้ามาจะถูกผูก room_id เพิ่มเติม เพื่อให้ log ของ hub นี้แยกออกจากห้องอื่นได้
+// aoiRadius/tickInterval มาจาก RoomRegistry ที่สร้างห้องนี้ (ดู aoiRadiusFromEnv/tickIntervalFromEnv)
+func newRoom(id, passphrase string, logger Logger, aoiRadius float64, tickInterval time.Duration) *Room {
+	hub := newHub(logger.With(F("room_id", id)), aoiRadius, tickInterval)
+	go hub.run()
+	return &Room{ID: id, Passphrase: passphrase, Hub: hub}
+}
+
+// RoomRegistry เก็บห้องทั้งหมดที่มีอยู่ ค้นหาได้ทั้งจาก room ID และจาก passphrase ที่ตั้งไว้ตอนสร้างห้อง
+type RoomRegistry struct {
+	logger Logger
+
+	aoiRadius    float64       // ผูกทุกห้องที่สร้างขึ้นให้ใช้ค่าเดียวกัน (ดู aoiRadiusFromEnv)
+	tickInterval time.Duration // ผูกทุกห้องที่สร้างขึ้นให้ใช้ค่าเดียวกัน (ดู tickIntervalFromEnv)
+
+	mu           sync.Mutex
+	rooms        map[string]*Room // คีย์ด้วย room ID
+	byPassphrase map[string]*Room // คีย์ด้วย passphrase (เฉพาะห้องที่ตั้ง passphrase ไว้)
+}
+
+// newRoomRegistry สร้าง RoomRegistry พร้อมห้อง default (defaultRoomID) ไว้ล่วงหน้าเสมอ
+// logger จะถูกส่งต่อให้ห้องทุกห้องที่สร้างขึ้น ทั้งตอนนี้และตอน findOrCreate ในอนาคต เช่นเดียวกับ
+// aoiRadius/tickInterval ที่ใช้ตั้งค่า hub ของทุกห้อง
+func newRoomRegistry(logger Logger, aoiRadius float64, tickInterval time.Duration) *RoomRegistry {
+	r := &RoomRegistry{
+		logger:       logger,
+		aoiRadius:    aoiRadius,
+		tickInterval: tickInterval,
+		rooms:        make(map[string]*Room),
+		byPassphrase: make(map[string]*Room),
+	}
+	r.rooms[defaultRoomID] = newRoom(defaultRoomID, "", logger, aoiRadius, tickInterval)
+	return r
+}
+
+// findOrCreate คืนห้องที่มี id นี้อยู่แล้ว หรือสร้างห้องใหม่ให้ถ้ายังไม่มี
+func (r *RoomRegistry) findOrCreate(id, passphrase string) *Room {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if room, ok := r.rooms[id]; ok {
+		return room
+	}
+
+	room := newRoom(id, passphrase, r.logger, r.aoiRadius, r.tickInterval)
+	r.rooms[id] = room
+	if passphrase != "" {
+		r.byPassphrase[passphrase] = room
+	}
+	return room
+}
+
+// findByPassphrase ค้นหาห้องจาก passphrase ที่ตั้งไว้ตอนสร้างห้อง โดยไม่สร้างห้องใหม่ให้
+func (r *RoomRegistry) findByPassphrase(passphrase string) (*Room, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	room, ok := r.byPassphrase[passphrase]
+	return room, ok
+}
+
+// resolveRoom หาห้องที่ conn นี้ควรเข้าร่วม โดยดูจาก query param ?room=/?passphrase= ก่อน
+// ถ้าไม่มีทั้งคู่ จะรออ่านข้อความถัดไปซึ่งต้องเป็น envelope action "join_room" แทน
+func resolveRoom(rooms *RoomRegistry, r *http.Request, conn *websocket.Conn) (*Room, error) {
+	if id := r.URL.Query().Get("room"); id != "" {
+		return rooms.findOrCreate(id, r.URL.Query().Get("passphrase")), nil
+	}
+	if passphrase := r.URL.Query().Get("passphrase"); passphrase != "" {
+		room, ok := rooms.findByPassphrase(passphrase)
+		if !ok {
+			return nil, fmt.Errorf("no room found for passphrase")
+		}
+		return room, nil
+	}
+
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		return nil, fmt.Errorf("reading join_room message: %w", err)
+	}
+
+	var env Envelope
+	if err := json.Unmarshal(msg, &env); err != nil {
+		return nil, fmt.Errorf("invalid join_room envelope: %w", err)
+	}
+	if env.Action != "join_room" {
+		return nil, fmt.Errorf("expected join_room action, got %q", env.Action)
+	}
+
+	var p JoinRoomPayload
+	if err := json.Unmarshal(env.Payload, &p); err != nil {
+		return nil, fmt.Errorf("invalid join_room payload: %w", err)
+	}
+
+	if p.RoomID != "" {
+		return rooms.findOrCreate(p.RoomID, p.Passphrase), nil
+	}
+	if p.Passphrase != "" {
+		room, ok := rooms.findByPassphrase(p.Passphrase)
+		if !ok {
+			return nil, fmt.Errorf("no room found for passphrase")
+		}
+		return room, nil
+	}
+	return nil, fmt.Errorf("room_id or passphrase is required")
+}